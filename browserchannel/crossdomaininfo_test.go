@@ -0,0 +1,47 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import "testing"
+
+func TestCrossDomainInfoMatchesOriginAllowedOrigins(t *testing.T) {
+	info := &crossDomainInfo{allowedOrigins: []string{"https://example.com", "null"}}
+
+	cases := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://example.com", true},
+		{"HTTPS://EXAMPLE.COM", true},
+		{"null", true},
+		{"NULL", true},
+		{"https://evil.com", false},
+		{"", false},
+	}
+
+	for _, c := range cases {
+		if got := info.matchesOrigin(c.origin); got != c.want {
+			t.Errorf("matchesOrigin(%q) = %v, want %v", c.origin, got, c.want)
+		}
+	}
+}
+
+func TestCrossDomainInfoMatchesOriginWildcard(t *testing.T) {
+	info := &crossDomainInfo{allowedOrigins: []string{"*"}}
+
+	if !info.matchesOrigin("https://anything.example") {
+		t.Error("matchesOrigin with a \"*\" entry should accept any origin")
+	}
+}
+
+func TestCrossDomainInfoMatchesOriginHostMatcher(t *testing.T) {
+	info := &crossDomainInfo{hostMatcher: makeOriginMatcher("example.com")}
+
+	if !info.matchesOrigin("http://example.com") {
+		t.Error("matchesOrigin should defer to hostMatcher when set")
+	}
+	if info.matchesOrigin("http://evil.com") {
+		t.Error("matchesOrigin should reject an origin the hostMatcher rejects")
+	}
+}
@@ -6,17 +6,16 @@
 package browserchannel
 
 import (
+	"context"
 	crand "crypto/rand"
 	"encoding/json"
 	"io"
-	"log"
 	"math/rand"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
@@ -39,6 +38,7 @@ const (
 	queryXmlHttp
 	queryHtml
 	queryTest
+	queryWebSocket
 )
 
 func parseQueryType(s string) (qtype queryType) {
@@ -51,6 +51,8 @@ func parseQueryType(s string) (qtype queryType) {
 		qtype = queryTerminate
 	case "test":
 		qtype = queryTest
+	case "websocket":
+		qtype = queryWebSocket
 	}
 	return
 }
@@ -90,6 +92,10 @@ type bindParams struct {
 	chunked bool
 	values  url.Values
 	method  string
+	// request is the originating HTTP request. It's kept around, in
+	// addition to the fields parsed from it above, because the WebSocket
+	// back channel needs it to perform the protocol upgrade.
+	request *http.Request
 }
 
 func parseBindParams(req *http.Request, values url.Values) (params *bindParams, err error) {
@@ -106,7 +112,7 @@ func parseBindParams(req *http.Request, values url.Values) (params *bindParams,
 	if err != nil {
 		return
 	}
-	params = &bindParams{cver, sid, qtype, domain, rid, aid, chunked, values, req.Method}
+	params = &bindParams{cver, sid, qtype, domain, rid, aid, chunked, values, req.Method, req}
 	return
 }
 
@@ -133,36 +139,29 @@ var headers = map[string]string{
 	"Pragma":                 "no-cache",
 }
 
-type channelMap struct {
-	sync.RWMutex
-	m map[SessionId]*Channel
-}
-
-func (m *channelMap) get(sid SessionId) *Channel {
-	m.RLock()
-	defer m.RUnlock()
-	return m.m[sid]
-}
-
-func (m *channelMap) set(sid SessionId, channel *Channel) {
-	m.Lock()
-	defer m.Unlock()
-	m.m[sid] = channel
-}
-
-func (m *channelMap) del(sid SessionId) (deleted bool) {
-	m.Lock()
-	defer m.Unlock()
-	_, deleted = m.m[sid]
-	delete(m.m, sid)
-	return
+// Contains the browser channel cross domain info. Either hostMatcher or
+// allowedOrigins is set, depending on whether the handler was configured
+// through SetCrossDomainPrefix or SetAllowedOrigins.
+type crossDomainInfo struct {
+	hostMatcher    *regexp.Regexp
+	allowedOrigins []string
+	domain         string
+	prefixes       []string
 }
 
-// Contains the browser channel cross domain info for a single domain.
-type crossDomainInfo struct {
-	hostMatcher *regexp.Regexp
-	domain      string
-	prefixes    []string
+// Reports whether origin is allowed to make cross domain requests against
+// this browser channel, per http://www.w3.org/TR/cors/ and
+// http://tools.ietf.org/html/rfc6454#section-7.1.
+func (info *crossDomainInfo) matchesOrigin(origin string) bool {
+	if info.hostMatcher != nil {
+		return info.hostMatcher.MatchString(origin)
+	}
+	for _, allowed := range info.allowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
 }
 
 func getHostPrefix(info *crossDomainInfo) string {
@@ -173,67 +172,143 @@ func getHostPrefix(info *crossDomainInfo) string {
 }
 
 // The browser channel HTTP handler will invoke its ChannelHandler in a
-// goroutine for each new browser channel connection established.
-type ChannelHandler func(*Channel)
+// goroutine for each new browser channel connection established. The
+// context is canceled when the channel's session times out or is
+// terminated, so handlers can select on ctx.Done() to shut down.
+type ChannelHandler func(ctx context.Context, channel *Channel)
+
+// ChannelMiddleware wraps a ChannelHandler with another, in the same spirit
+// as the http.Handler middleware registered through Handler.Use, but with
+// access to the *Channel itself.
+type ChannelMiddleware func(ChannelHandler) ChannelHandler
 
 // The browser channel http.Handler.
 type Handler struct {
-	corsInfo    *crossDomainInfo
-	prefix      string
-	channels    *channelMap
-	bindPath    string
-	testPath    string
-	gcChan      chan SessionId
-	chanHandler ChannelHandler
+	corsInfo         *crossDomainInfo
+	prefix           string
+	store            SessionStore
+	bindPath         string
+	testPath         string
+	gcChan           chan SessionId
+	chanHandler      ChannelHandler
+	chanMiddleware   ChannelMiddleware
+	middleware       []func(http.Handler) http.Handler
+	webSocketEnabled bool
+	logger           Logger
+	// nodeId identifies this process to the SessionStore, so a Publish this
+	// node makes can be recognized and skipped by its own Subscribe loop.
+	nodeId string
 }
 
-// Creates a new browser channel HTTP handler. The last path segment of the
-// URL is used to distinguish bind and test connections.
+// Creates a new browser channel HTTP handler backed by an in-memory
+// SessionStore. The last path segment of the URL is used to distinguish
+// bind and test connections.
 func NewHandler(chanHandler ChannelHandler) (h *Handler) {
+	return NewHandlerWithStore(chanHandler, NewMemorySessionStore())
+}
+
+// NewHandlerWithStore is like NewHandler but lets the caller supply the
+// SessionStore backing the handler, e.g. a Redis or NATS-backed store
+// shared across multiple Go processes behind a load balancer.
+func NewHandlerWithStore(chanHandler ChannelHandler, store SessionStore) (h *Handler) {
 	h = new(Handler)
-	h.channels = &channelMap{m: make(map[SessionId]*Channel)}
+	h.store = store
 	h.bindPath = DefaultBindPath
 	h.testPath = DefaultTestPath
 	h.gcChan = make(chan SessionId, 10)
 	h.chanHandler = chanHandler
-	go h.removeClosedSession()
+	h.logger = noopLogger{}
+	h.nodeId = newCorrelationId()
+	go store.GC(h.gcChan, h.logRemovedSession)
 	return
 }
 
+// Use registers HTTP middleware that wraps every request handled by this
+// Handler, in the style of gorilla/mux's Router.Use. Middleware is applied
+// in the order it's registered, so the first one added is the outermost.
+// This runs before the bind/test path is even determined, making it the
+// right place for authentication, request logging or metrics collection
+// that should apply uniformly across the handler.
+func (h *Handler) Use(mw ...func(http.Handler) http.Handler) {
+	h.middleware = append(h.middleware, mw...)
+}
+
+// SetChannelMiddleware installs a ChannelMiddleware that wraps the
+// ChannelHandler passed to NewHandler. Unlike Use, this runs on the
+// goroutine spawned for a newly created *Channel, so it can see and
+// annotate the channel before the handler's first statement executes.
+func (h *Handler) SetChannelMiddleware(mw ChannelMiddleware) {
+	h.chanMiddleware = mw
+}
+
 // Sets the cross domain information for this browser channel. The origin is
 // used as the Access-Control-Allow-Origin header value and should respect the
 // format specified by http://www.w3.org/TR/cors/. The prefixes are used to set
 // the hostPrefix parameter on the client side. The prefix assigned to each
 // browser channel session is chosen randomly from the array of prefixes.
 func (h *Handler) SetCrossDomainPrefix(domain string, prefixes []string) {
-	h.corsInfo = &crossDomainInfo{makeOriginMatcher(domain), domain, prefixes}
+	h.corsInfo = &crossDomainInfo{hostMatcher: makeOriginMatcher(domain), domain: domain, prefixes: prefixes}
 }
 
-// Removes closed channels from the handler's channel map.
-func (h *Handler) removeClosedSession() {
-	for {
-		sid, ok := <-h.gcChan
-		if !ok {
-			break
-		}
-
-		log.Printf("removing %s from session map\n", sid)
+// Sets the list of origins allowed to make cross domain requests against
+// this browser channel, as an alternative to SetCrossDomainPrefix for
+// callers who need to whitelist several distinct origins rather than
+// encoding them all into a single regular expression (mirroring the
+// "discoveryAllowedOrigins" pattern used by identity servers). Each entry
+// in origins is compared case-insensitively against the request's Origin
+// header and must be an exact match, or "*" or "null" as permitted by
+// http://tools.ietf.org/html/rfc6454#section-7.1. The prefixes are used as
+// described in SetCrossDomainPrefix.
+func (h *Handler) SetAllowedOrigins(origins []string, prefixes []string) {
+	h.corsInfo = &crossDomainInfo{allowedOrigins: origins, prefixes: prefixes}
+}
 
-		if !h.channels.del(sid) {
-			log.Printf("missing channel for %s in session map\n", sid)
-		}
+// logRemovedSession is the store's GC callback: it logs every session
+// removal, every channel sends its sid on gcChan once it closes, whether
+// through timeout or an explicit terminate.
+func (h *Handler) logRemovedSession(sid SessionId, channel *Channel) {
+	if channel == nil {
+		h.logger.Warnf(sid, "missing channel for %s in session map", sid)
+		return
 	}
+	h.logger.Infof(sid, "removing %s from session map (cid=%s)", sid, channel.correlationId())
 }
 
 func (h *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	var handler http.Handler = http.HandlerFunc(h.serveBrowserChannel)
+	for i := len(h.middleware) - 1; i >= 0; i-- {
+		handler = h.middleware[i](handler)
+	}
+	handler.ServeHTTP(rw, req)
+}
+
+// serveBrowserChannel holds the actual bind/test dispatch logic that used to
+// live directly in ServeHTTP, now wrapped by any middleware registered
+// through Use.
+func (h *Handler) serveBrowserChannel(rw http.ResponseWriter, req *http.Request) {
 	// The CORS  spec only supports *, null or the exact domain.
 	// http://www.w3.org/TR/cors/#access-control-allow-origin-response-header
 	// http://tools.ietf.org/html/rfc6454#section-7.1
 	origin := req.Header.Get("origin")
-	if len(origin) > 0 && h.corsInfo != nil &&
-		h.corsInfo.hostMatcher.MatchString(origin) {
+	if len(origin) > 0 && h.corsInfo != nil && h.corsInfo.matchesOrigin(origin) {
 		rw.Header().Set("Access-Control-Allow-Origin", origin)
 		rw.Header().Set("Access-Control-Allow-Credentials", "true")
+		rw.Header().Set("Vary", "Origin")
+	}
+
+	path := req.URL.Path
+	isBindPath := strings.HasSuffix(path, h.bindPath)
+	isTestPath := strings.HasSuffix(path, h.testPath)
+
+	// Answer CORS preflight requests for the bind and test paths directly.
+	// Browsers send these ahead of cross-domain bind requests that aren't
+	// "simple" requests (e.g. ones using a non-GET/POST method or a
+	// non-simple header), and expect the allowed methods and headers back without the
+	// request ever reaching the bind or test handling below. Anything else
+	// still falls through to the 404 branch, same as before this existed.
+	if req.Method == "OPTIONS" && (isBindPath || isTestPath) {
+		h.handlePreflightRequest(rw)
+		return
 	}
 
 	// The body is parsed before calling ParseForm so the values don't get
@@ -246,10 +321,15 @@ func (h *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 
 	req.ParseForm()
 
-	path := req.URL.Path
-	if strings.HasSuffix(path, h.testPath) {
+	if isTestPath {
 		h.handleTestRequest(rw, parseTestParams(req))
-	} else if strings.HasSuffix(path, h.bindPath) {
+	} else if isBindPath {
+		// Each bind request gets its own correlation id so its log lines can
+		// be tied together even before the session id is known (e.g. an
+		// Unknown SID lookup failure), and tied to every other bind request
+		// the same session makes over its lifetime once it is.
+		req = req.WithContext(withCorrelationId(req.Context(), newCorrelationId()))
+
 		params, err := parseBindParams(req, values)
 		if err != nil {
 			rw.WriteHeader(400)
@@ -261,13 +341,29 @@ func (h *Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// Responds to a CORS preflight OPTIONS request with the methods and headers
+// a bind request may use. This only matters for cross-domain setups; the
+// Access-Control-Allow-Origin and -Credentials headers are already set, if
+// applicable, by the caller before this is reached.
+func (h *Handler) handlePreflightRequest(rw http.ResponseWriter) {
+	rw.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	rw.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	rw.WriteHeader(200)
+}
+
 func (h *Handler) handleTestRequest(rw http.ResponseWriter, params *testParams) {
 	if params.ver != SupportedProcolVersion {
 		rw.WriteHeader(400)
 		io.WriteString(rw, "Unsupported protocol version.")
 	} else if params.init {
 		rw.WriteHeader(200)
-		io.WriteString(rw, "[\""+getHostPrefix(h.corsInfo)+"\",\"\"]")
+		// The second element of the init response tells the client whether
+		// it may skip the forward/back channel bind dance in favor of a
+		// single WebSocket back channel; it only does so if both the server
+		// has WebSocket enabled and the client asked for it with
+		// TYPE=websocket on this request.
+		webSocketSupported := h.webSocketEnabled && params.qtype == queryWebSocket
+		io.WriteString(rw, "[\""+getHostPrefix(h.corsInfo)+"\","+strconv.FormatBool(webSocketSupported)+"]")
 	} else {
 		params.qtype.setContentType(rw)
 		setHeaders(rw, &headers)
@@ -305,14 +401,19 @@ func (h *Handler) handleBindRequest(rw http.ResponseWriter, params *bindParams)
 	sid := params.sid
 
 	// If the client has specified a session id, lookup the session object in
-	// the sessions map. Lookup failure should be signaled to the client using
-	// a 400 status code and a message containing 'Unknown SID'. See
-	// goog/net/channelrequest.js for more context on how this error is
-	// handled.
+	// the sessions map. Get only ever sees sessions this node created (see
+	// SessionStore), so a lookup failure here means either the sid is
+	// genuinely unknown or hostPrefix stickiness broke down and this
+	// request landed on the wrong node; either way it's signaled to the
+	// client the same way, with a 400 status code and a message containing
+	// 'Unknown SID'. See goog/net/channelrequest.js for more context on how
+	// this error is handled.
+	cid := correlationIdFromContext(params.request.Context())
+
 	if sid != nullSessionId {
-		channel = h.channels.get(sid)
+		channel, _ = h.store.Get(sid)
 		if channel == nil {
-			log.Printf("failed to lookup session %s\n", sid)
+			h.logger.Warnf(sid, "failed to lookup session %s (cid=%s)", sid, cid)
 			setHeaders(rw, &headers)
 			rw.WriteHeader(400)
 			io.WriteString(rw, "Unknown SID")
@@ -322,11 +423,25 @@ func (h *Handler) handleBindRequest(rw http.ResponseWriter, params *bindParams)
 
 	if channel == nil {
 		sid, _ = generateSesionId(crand.Reader)
-		log.Printf("creating session %s\n", sid)
-		channel = newChannel(params.cver, sid, h.gcChan, h.corsInfo)
-		h.channels.set(sid, channel)
+		h.logger.Infof(sid, "creating session %s (cid=%s)", sid, cid)
+		// The channel's context is rooted in this first bind request's
+		// context, but outlives it: newChannel keeps it alive independently
+		// and cancels it itself on session timeout or terminate, rather than
+		// tying the whole channel's lifetime to this one request.
+		channel = newChannel(params.request.Context(), params.cver, sid, h.gcChan, h.corsInfo)
+		// The correlation id of the bind request that created this channel
+		// is kept on it and included in the log line for the session's
+		// removal, so that line can be traced back to how the session
+		// started. Each later bind request logs its own correlation id.
+		channel.attachCorrelationId(cid)
+		h.store.Put(channel)
 		channel.armChannelTimeout()
-		go h.chanHandler(channel)
+
+		chanHandler := h.chanHandler
+		if h.chanMiddleware != nil {
+			chanHandler = h.chanMiddleware(chanHandler)
+		}
+		go chanHandler(channel.Context(), channel)
 	}
 
 	if params.aid != -1 {
@@ -351,11 +466,20 @@ func (h *Handler) handleBindPost(rw http.ResponseWriter, params *bindParams, cha
 	}
 
 	if err := channel.receiveMaps(offset, maps); err != nil {
-		log.Printf("%s: %s\n", channel.Sid, err)
+		h.logger.Errorf(channel.Sid, "%s (cid=%s)", err, correlationIdFromContext(params.request.Context()))
 		rw.WriteHeader(500)
 		return
 	}
 
+	// Publish hands these maps to the store, which may pass them on to
+	// other nodes subscribed to this session. A forward request only gets
+	// this far on the node whose store holds the channel; a request that
+	// lands on any other node was already answered with Unknown SID in
+	// handleBindRequest. Origin is this node's own id so that
+	// if this node is also the one subscribed to sid, it can recognize
+	// and skip the event it just applied above instead of double-applying it.
+	h.store.Publish(channel.Sid, Event{Origin: h.nodeId, Offset: offset, Maps: maps})
+
 	if channel.state == channelInit {
 		setHeaders(rw, &headers)
 		rw.WriteHeader(200)
@@ -369,7 +493,7 @@ func (h *Handler) handleBindPost(rw http.ResponseWriter, params *bindParams, cha
 		// length prefixed array reply as is sent to the XHR streaming clients.
 		backChannel := newBackChannel(channel.Sid, rw, false, "", params.rid)
 		channel.setBackChannel(backChannel)
-		backChannel.wait()
+		h.waitForBackChannel(params.request.Context(), channel, backChannel.done, backChannel.close)
 	} else {
 		// On normal forward channel request, the session status is returned
 		// to the client. The session status contains 3 pieces of information:
@@ -386,6 +510,8 @@ func (h *Handler) handleBindPost(rw http.ResponseWriter, params *bindParams, cha
 func (h *Handler) handleBindGet(rw http.ResponseWriter, params *bindParams, channel *Channel) {
 	if params.qtype == queryTerminate {
 		channel.terminate()
+	} else if params.qtype == queryWebSocket {
+		h.handleBindWebSocket(rw, params, channel)
 	} else {
 		params.qtype.setContentType(rw)
 		setHeaders(rw, &headers)
@@ -396,6 +522,45 @@ func (h *Handler) handleBindGet(rw http.ResponseWriter, params *bindParams, chan
 		bc := newBackChannel(channel.Sid, rw, isHtml, params.domain, params.rid)
 		bc.setChunked(params.chunked)
 		channel.setBackChannel(bc)
-		bc.wait()
+		h.waitForBackChannel(params.request.Context(), channel, bc.done, bc.close)
+	}
+}
+
+// waitForBackChannel blocks until the back channel identified by done
+// finishes on its own, ctx is canceled because the underlying request's
+// connection was dropped, or the store delivers a Handoff Event for this
+// session because another node has taken over its back channel. The last
+// two end in closeFn being called so the channel promptly releases the
+// back channel, letting the next long-poll request (or the other node)
+// take its place; any other Event just has its maps applied and the wait
+// continues. Events this node published itself are skipped, since it
+// already applied those maps in-process before publishing them.
+func (h *Handler) waitForBackChannel(ctx context.Context, channel *Channel, done <-chan struct{}, closeFn func()) {
+	events := h.store.Subscribe(channel.Sid)
+	for {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+			closeFn()
+			return
+		case event, ok := <-events:
+			if !ok {
+				events = nil
+				continue
+			}
+			if event.Origin == h.nodeId {
+				continue
+			}
+			if len(event.Maps) > 0 {
+				if err := channel.receiveMaps(event.Offset, event.Maps); err != nil {
+					h.logger.Errorf(channel.Sid, "%s (cid=%s)", err, correlationIdFromContext(ctx))
+				}
+			}
+			if event.Handoff {
+				closeFn()
+				return
+			}
+		}
 	}
 }
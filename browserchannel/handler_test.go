@@ -0,0 +1,35 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"context"
+	crand "crypto/rand"
+	"testing"
+	"time"
+)
+
+func TestWaitForBackChannelClosesOnContextCancel(t *testing.T) {
+	h := NewHandler(func(ctx context.Context, channel *Channel) {})
+
+	sid, err := generateSesionId(crand.Reader)
+	if err != nil {
+		t.Fatalf("generateSesionId() error = %v", err)
+	}
+	channel := newChannel(context.Background(), "8", sid, h.gcChan, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	closed := make(chan struct{})
+	closeFn := func() { close(closed) }
+
+	go h.waitForBackChannel(ctx, channel, done, closeFn)
+	cancel()
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("waitForBackChannel did not call closeFn after context cancellation")
+	}
+}
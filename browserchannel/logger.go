@@ -0,0 +1,133 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"log/slog"
+)
+
+// Logger is the interface through which a Handler reports session
+// lifecycle events and errors. Every method takes the session id of the
+// channel the message concerns. Set one with Handler.SetLogger; a
+// Handler created without one logs nothing.
+type Logger interface {
+	Debugf(sid SessionId, format string, args ...interface{})
+	Infof(sid SessionId, format string, args ...interface{})
+	Warnf(sid SessionId, format string, args ...interface{})
+	Errorf(sid SessionId, format string, args ...interface{})
+}
+
+// SetLogger installs the Logger used to report session lifecycle events
+// and errors. Without a call to SetLogger, a Handler logs nothing.
+func (h *Handler) SetLogger(logger Logger) {
+	h.logger = logger
+}
+
+// noopLogger is the default Logger for a Handler that hasn't had
+// SetLogger called on it. It discards everything, matching the
+// principle of least surprise for a library that shouldn't write to
+// stderr unless asked to.
+type noopLogger struct{}
+
+func (noopLogger) Debugf(sid SessionId, format string, args ...interface{}) {}
+func (noopLogger) Infof(sid SessionId, format string, args ...interface{})  {}
+func (noopLogger) Warnf(sid SessionId, format string, args ...interface{})  {}
+func (noopLogger) Errorf(sid SessionId, format string, args ...interface{}) {}
+
+// stdLogAdapter adapts the standard library's log package to the Logger
+// interface, prefixing every line with its level and the session id. It's
+// the closest equivalent to this package's old, unconditional use of
+// log.Printf.
+type stdLogAdapter struct {
+	logger *log.Logger
+}
+
+// NewStdLogAdapter wraps logger, or the standard library's default logger
+// if logger is nil, as a Logger.
+func NewStdLogAdapter(logger *log.Logger) Logger {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return &stdLogAdapter{logger}
+}
+
+func (a *stdLogAdapter) log(level string, sid SessionId, format string, args []interface{}) {
+	a.logger.Printf("%s session_id=%s "+format, append([]interface{}{level, sid}, args...)...)
+}
+
+func (a *stdLogAdapter) Debugf(sid SessionId, format string, args ...interface{}) {
+	a.log("DEBUG", sid, format, args)
+}
+
+func (a *stdLogAdapter) Infof(sid SessionId, format string, args ...interface{}) {
+	a.log("INFO", sid, format, args)
+}
+
+func (a *stdLogAdapter) Warnf(sid SessionId, format string, args ...interface{}) {
+	a.log("WARN", sid, format, args)
+}
+
+func (a *stdLogAdapter) Errorf(sid SessionId, format string, args ...interface{}) {
+	a.log("ERROR", sid, format, args)
+}
+
+// slogAdapter adapts an *slog.Logger to the Logger interface, attaching
+// the session id as a structured "session_id" attribute rather than
+// folding it into the message text.
+type slogAdapter struct {
+	logger *slog.Logger
+}
+
+// NewSlogAdapter wraps logger, or slog.Default() if logger is nil, as a
+// Logger.
+func NewSlogAdapter(logger *slog.Logger) Logger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &slogAdapter{logger}
+}
+
+func (a *slogAdapter) Debugf(sid SessionId, format string, args ...interface{}) {
+	a.logger.Debug(fmt.Sprintf(format, args...), "session_id", sid)
+}
+
+func (a *slogAdapter) Infof(sid SessionId, format string, args ...interface{}) {
+	a.logger.Info(fmt.Sprintf(format, args...), "session_id", sid)
+}
+
+func (a *slogAdapter) Warnf(sid SessionId, format string, args ...interface{}) {
+	a.logger.Warn(fmt.Sprintf(format, args...), "session_id", sid)
+}
+
+func (a *slogAdapter) Errorf(sid SessionId, format string, args ...interface{}) {
+	a.logger.Error(fmt.Sprintf(format, args...), "session_id", sid)
+}
+
+// newCorrelationId generates a short random id. Every bind request gets
+// one, included in the log lines that request produces; a channel keeps
+// the id of the request that created it for the log line of its removal.
+// A Handler also uses one as its nodeId.
+func newCorrelationId() string {
+	b := make([]byte, 8)
+	if _, err := crand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+type correlationIdKey struct{}
+
+func withCorrelationId(ctx context.Context, cid string) context.Context {
+	return context.WithValue(ctx, correlationIdKey{}, cid)
+}
+
+func correlationIdFromContext(ctx context.Context) string {
+	cid, _ := ctx.Value(correlationIdKey{}).(string)
+	return cid
+}
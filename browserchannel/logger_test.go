@@ -0,0 +1,23 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCorrelationIdRoundTrip(t *testing.T) {
+	ctx := withCorrelationId(context.Background(), "abc123")
+
+	if got := correlationIdFromContext(ctx); got != "abc123" {
+		t.Errorf("correlationIdFromContext() = %q, want %q", got, "abc123")
+	}
+}
+
+func TestCorrelationIdFromContextMissing(t *testing.T) {
+	if got := correlationIdFromContext(context.Background()); got != "" {
+		t.Errorf("correlationIdFromContext() on a bare context = %q, want \"\"", got)
+	}
+}
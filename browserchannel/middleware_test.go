@@ -0,0 +1,70 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUseAppliesMiddlewareInOrder(t *testing.T) {
+	h := NewHandler(func(ctx context.Context, channel *Channel) {})
+
+	var order []string
+	mw := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				order = append(order, name+":before")
+				next.ServeHTTP(rw, req)
+				order = append(order, name+":after")
+			})
+		}
+	}
+	h.Use(mw("outer"), mw("inner"))
+
+	req := httptest.NewRequest("GET", "/unknown", nil)
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	want := []string{"outer:before", "inner:before", "inner:after", "outer:after"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("middleware order = %v, want %v", order, want)
+	}
+	if rw.Code != 404 {
+		t.Errorf("status = %d, want 404", rw.Code)
+	}
+}
+
+func TestSetChannelMiddlewareWrapsHandler(t *testing.T) {
+	h := NewHandler(func(ctx context.Context, channel *Channel) {})
+
+	var middlewareRan bool
+	called := make(chan struct{}, 1)
+	h.SetChannelMiddleware(func(next ChannelHandler) ChannelHandler {
+		return func(ctx context.Context, channel *Channel) {
+			middlewareRan = true
+			next(ctx, channel)
+			called <- struct{}{}
+		}
+	})
+
+	req := httptest.NewRequest("POST", "/bind?VER=8", strings.NewReader("count=0"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatal("ChannelMiddleware never ran")
+	}
+	if !middlewareRan {
+		t.Error("SetChannelMiddleware's wrapper did not run")
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import "sync"
+
+// SessionStore abstracts where a Handler keeps bookkeeping for the
+// sessions it's currently serving. A *Channel is a live, process-local Go
+// value (goroutines, timers, an open back channel connection), so Get,
+// Put, Delete and GC only ever see the sessions this process created: they
+// are not a mechanism for one node to reach a session owned by another.
+// That's what hostPrefix (see SetCrossDomainPrefix) is for: a client is
+// handed one prefix for the life of a session so a load balancer keyed on
+// it sends every request for that session to the same node. Publish and
+// Subscribe are the only members of this interface that cross node
+// boundaries, carrying maps (and back channel handoff) to other nodes
+// subscribed to a session. Handler publishes only from the node whose
+// store holds the session: a forward or back channel request that lands
+// on any other node is answered with Unknown SID and is not relayed.
+type SessionStore interface {
+	// Get returns the channel for sid, if this node is holding it.
+	Get(sid SessionId) (channel *Channel, ok bool)
+	// Put registers channel in the store under its Sid.
+	Put(channel *Channel)
+	// Delete removes sid from the store.
+	Delete(sid SessionId)
+	// Publish fans event out to every other node subscribed to sid, not
+	// back to the publishing node, which has already applied it locally.
+	// It's called with the maps from a forward channel request, so a node
+	// other than the one handling this call, but holding sid's back
+	// channel open, can pick them up through its Subscribe channel.
+	Publish(sid SessionId, event Event)
+	// Subscribe returns the channel of Events for sid that Publish calls
+	// from other nodes feed. A node holding sid's back channel open reads
+	// from this to relay forwarded maps, and to learn when another node
+	// has taken over the back channel so it can release its own.
+	Subscribe(sid SessionId) <-chan Event
+	// GC consumes session ids from closed as this node's own channels
+	// finish and removes them from the store. It replaces the
+	// Handler-owned removal goroutine that used to reach into a bare map
+	// directly, so each store can use its own removal strategy (ours
+	// deletes immediately; a Redis-backed store might rely on key expiry
+	// and ignore closed entirely). onRemoved is invoked once per sid
+	// consumed, with the channel that was removed, or nil if none was
+	// found, so the caller can log the removal.
+	GC(closed <-chan SessionId, onRemoved func(sid SessionId, channel *Channel))
+}
+
+// Event is published on a SessionStore's Subscribe channel to notify the
+// node currently holding a session's back channel open.
+type Event struct {
+	// Origin identifies the node that published this event, so a node
+	// subscribed to its own publish can recognize and ignore it instead
+	// of double-applying maps it already handled locally.
+	Origin string
+	// Offset and Maps mirror the forward channel request that produced
+	// this event, to be applied to the channel via Channel.receiveMaps.
+	Offset int
+	Maps   []map[string]string
+	// Handoff is set when another node has taken over this session's back
+	// channel request; the node receiving it should release its own.
+	Handoff bool
+}
+
+// memorySessionStore is the default, single-process SessionStore used by
+// NewHandler. It keeps every live *Channel in an in-memory map guarded by
+// a mutex, exactly as the handler used to do directly before SessionStore
+// existed.
+type memorySessionStore struct {
+	sync.RWMutex
+	m map[SessionId]*Channel
+}
+
+// NewMemorySessionStore creates a SessionStore that keeps every session in
+// this process's memory. For multiple Go processes behind a load
+// balancer, implement SessionStore against a shared backend instead.
+func NewMemorySessionStore() SessionStore {
+	return &memorySessionStore{m: make(map[SessionId]*Channel)}
+}
+
+func (s *memorySessionStore) Get(sid SessionId) (*Channel, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	channel, ok := s.m[sid]
+	return channel, ok
+}
+
+func (s *memorySessionStore) Put(channel *Channel) {
+	s.Lock()
+	defer s.Unlock()
+	s.m[channel.Sid] = channel
+}
+
+func (s *memorySessionStore) Delete(sid SessionId) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.m, sid)
+}
+
+// Publish is a no-op: a single process always holds both the forward and
+// back channel for any session in its own map, so the maps were already
+// applied in-process by the time Publish would be called.
+func (s *memorySessionStore) Publish(sid SessionId, event Event) {}
+
+// Subscribe always returns nil: see Publish.
+func (s *memorySessionStore) Subscribe(sid SessionId) <-chan Event {
+	return nil
+}
+
+func (s *memorySessionStore) GC(closed <-chan SessionId, onRemoved func(SessionId, *Channel)) {
+	for sid := range closed {
+		channel, _ := s.Get(sid)
+		s.Delete(sid)
+		if onRemoved != nil {
+			onRemoved(sid, channel)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// checkWebSocketOrigin decides whether a WebSocket upgrade is allowed to
+// proceed. Unlike an ordinary cross-origin fetch/XHR, a WebSocket upgrade
+// isn't constrained by the browser's same-origin policy, so this is the
+// only thing standing between the handler and cross-site WebSocket
+// hijacking: it must reject a disallowed origin outright rather than just
+// skip setting response headers, as serveBrowserChannel does for the
+// XHR/HTML transports.
+func (h *Handler) checkWebSocketOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if h.corsInfo != nil {
+		return h.corsInfo.matchesOrigin(origin)
+	}
+	return origin == "" || isSameHost(req, origin)
+}
+
+func isSameHost(req *http.Request, origin string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == req.Host
+}
+
+// EnableWebSocket turns on the optional WebSocket back channel transport.
+// Once enabled, a bind GET request with TYPE=websocket upgrades the
+// connection and the back channel is served over that single duplex
+// socket for the lifetime of the session, instead of the chunked
+// XHR/HTML streaming back channel. The forward channel keeps using
+// ordinary POST requests; only the back channel moves to the socket.
+func (h *Handler) EnableWebSocket() {
+	h.webSocketEnabled = true
+}
+
+// handleBindWebSocket upgrades a bind GET request carrying TYPE=websocket
+// to a WebSocket connection and installs it as the channel's back channel.
+// If WebSocket support hasn't been enabled on the handler, it falls back
+// to reporting the request as bad, since the client shouldn't have asked
+// for it without the server having advertised support in handleTestRequest.
+func (h *Handler) handleBindWebSocket(rw http.ResponseWriter, params *bindParams, channel *Channel) {
+	if !h.webSocketEnabled {
+		rw.WriteHeader(400)
+		return
+	}
+
+	req := params.request
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     h.checkWebSocketOrigin,
+	}
+	conn, err := upgrader.Upgrade(rw, req, nil)
+	if err != nil {
+		return
+	}
+
+	bc := newWebSocketBackChannel(channel.Sid, conn)
+	channel.setBackChannel(bc)
+	h.waitForBackChannel(req.Context(), channel, bc.done, bc.close)
+}
+
+// websocketBackChannel is a backChannel implementation that writes each
+// outgoing batch of arrays as a single WebSocket text frame, rather than
+// buffering it into a chunked HTTP response body. It implements the same
+// send/flush/wait/close contract as the existing chunked backChannel so
+// that Channel.receiveMaps and Channel.acknowledgeArrays don't need to
+// know which transport is in use.
+type websocketBackChannel struct {
+	sid       SessionId
+	conn      *websocket.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newWebSocketBackChannel(sid SessionId, conn *websocket.Conn) *websocketBackChannel {
+	return &websocketBackChannel{sid: sid, conn: conn, done: make(chan struct{})}
+}
+
+// send writes arrays to the socket as a single JSON-encoded text frame,
+// mirroring the length-prefixed array payload sent over the chunked
+// transports.
+func (bc *websocketBackChannel) send(arrays []array) error {
+	b, err := json.Marshal(arrays)
+	if err != nil {
+		return err
+	}
+	return bc.conn.WriteMessage(websocket.TextMessage, b)
+}
+
+// flush is a no-op: each send is already written as its own frame, so
+// there's nothing buffered to push out.
+func (bc *websocketBackChannel) flush() {}
+
+// setChunked is a no-op: the WebSocket transport always streams frames
+// individually, so HTTP chunked-transfer framing doesn't apply.
+func (bc *websocketBackChannel) setChunked(chunked bool) {}
+
+func (bc *websocketBackChannel) wait() {
+	<-bc.done
+}
+
+func (bc *websocketBackChannel) close() {
+	bc.closeOnce.Do(func() {
+		close(bc.done)
+		bc.conn.Close()
+	})
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2013 Mathieu Turcotte
+// Licensed under the MIT license.
+
+package browserchannel
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCheckWebSocketOriginSameHost(t *testing.T) {
+	h := NewHandler(nil)
+
+	req := httptest.NewRequest("GET", "http://example.com/bind", nil)
+	req.Header.Set("Origin", "http://example.com")
+
+	if !h.checkWebSocketOrigin(req) {
+		t.Error("checkWebSocketOrigin should accept an origin matching the request host")
+	}
+}
+
+func TestCheckWebSocketOriginEmptyAcceptedWhenUnconfigured(t *testing.T) {
+	h := NewHandler(nil)
+
+	req := httptest.NewRequest("GET", "http://example.com/bind", nil)
+
+	if !h.checkWebSocketOrigin(req) {
+		t.Error("checkWebSocketOrigin should accept a missing origin when corsInfo isn't set")
+	}
+}
+
+func TestCheckWebSocketOriginMismatchedHostRejected(t *testing.T) {
+	h := NewHandler(nil)
+
+	req := httptest.NewRequest("GET", "http://example.com/bind", nil)
+	req.Header.Set("Origin", "http://evil.com")
+
+	if h.checkWebSocketOrigin(req) {
+		t.Error("checkWebSocketOrigin should reject an origin that doesn't match the request host")
+	}
+}
+
+func TestCheckWebSocketOriginUsesCorsInfo(t *testing.T) {
+	h := NewHandler(nil)
+	h.SetAllowedOrigins([]string{"https://example.com"}, nil)
+
+	req := httptest.NewRequest("GET", "http://example.com/bind", nil)
+	req.Header.Set("Origin", "https://example.com")
+	if !h.checkWebSocketOrigin(req) {
+		t.Error("checkWebSocketOrigin should accept an origin matched by corsInfo")
+	}
+
+	req.Header.Set("Origin", "https://evil.com")
+	if h.checkWebSocketOrigin(req) {
+		t.Error("checkWebSocketOrigin should reject an origin not matched by corsInfo")
+	}
+}
+
+func TestCheckWebSocketOriginUsesCorsInfoWildcard(t *testing.T) {
+	h := NewHandler(nil)
+	h.SetAllowedOrigins([]string{"*"}, nil)
+
+	req := httptest.NewRequest("GET", "http://example.com/bind", nil)
+	req.Header.Set("Origin", "https://anything.example")
+
+	if !h.checkWebSocketOrigin(req) {
+		t.Error("checkWebSocketOrigin should accept any origin when corsInfo allows \"*\"")
+	}
+}
+
+func TestCheckWebSocketOriginUsesCorsInfoNull(t *testing.T) {
+	h := NewHandler(nil)
+	h.SetAllowedOrigins([]string{"null"}, nil)
+
+	req := httptest.NewRequest("GET", "http://example.com/bind", nil)
+	req.Header.Set("Origin", "null")
+
+	if !h.checkWebSocketOrigin(req) {
+		t.Error("checkWebSocketOrigin should accept the \"null\" origin when corsInfo allows it")
+	}
+}
+
+func TestCheckWebSocketOriginEmptyRejectedWhenConfigured(t *testing.T) {
+	h := NewHandler(nil)
+	h.SetAllowedOrigins([]string{"https://example.com"}, nil)
+
+	req := httptest.NewRequest("GET", "http://example.com/bind", nil)
+
+	if h.checkWebSocketOrigin(req) {
+		t.Error("checkWebSocketOrigin should reject a missing origin once corsInfo is configured")
+	}
+}